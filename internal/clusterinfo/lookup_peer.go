@@ -1,12 +1,18 @@
 package clusterinfo
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/golang/snappy"
 	"github.com/youzan/go-nsq"
 	"github.com/youzan/nsq/internal/levellogger"
 )
@@ -20,10 +26,85 @@ type LookupPeer struct {
 	l               levellogger.Logger
 	addr            string
 	conn            net.Conn
+	r               io.Reader
+	w               io.Writer
+	tlsConfig       *tls.Config
+	compression     Compression
+	observer        LookupObserver
 	state           int32
 	connectCallback func(*LookupPeer)
 	maxBodySize     int64
 	Info            peerInfo
+
+	// mu serializes CommandAsync's connect-then-write-then-enqueue against
+	// concurrent CommandAsync callers (so wire order and queue order can
+	// never diverge) and guards async itself. CommandAsync holds it across
+	// ensureConnectedLocked and closeWithReasonLocked. The synchronous
+	// Command/CommandPipeline path does not hold it around its I/O and
+	// assumes a single owner, same as always; it only takes it briefly
+	// inside closeWithReason.
+	mu    sync.Mutex
+	async *asyncQueue
+}
+
+// Compression identifies an optional wire-level compression scheme that may
+// be negotiated with nsqlookupd on top of an (optionally TLS) connection.
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+)
+
+// LookupPeerOption configures optional behavior on a LookupPeer, applied by
+// NewLookupPeer.
+type LookupPeerOption func(*LookupPeer)
+
+// WithTLSConfig causes the LookupPeer to negotiate TLS with nsqlookupd
+// immediately after the MagicV1 handshake, upgrading the connection with
+// cfg if the peer acknowledges support for it.
+func WithTLSConfig(cfg *tls.Config) LookupPeerOption {
+	return func(lp *LookupPeer) {
+		lp.tlsConfig = cfg
+	}
+}
+
+// WithCompression causes the LookupPeer to negotiate the given compression
+// scheme with nsqlookupd immediately after the MagicV1 handshake.
+func WithCompression(c Compression) LookupPeerOption {
+	return func(lp *LookupPeer) {
+		lp.compression = c
+	}
+}
+
+// WithObserver attaches a LookupObserver that is notified of connect,
+// command, and disconnect events on this LookupPeer.
+func WithObserver(o LookupObserver) LookupPeerOption {
+	return func(lp *LookupPeer) {
+		lp.observer = o
+	}
+}
+
+// LookupObserver receives lifecycle and round-trip events from a
+// LookupPeer. Implementations should return quickly, since hooks are
+// called inline on the connect/command path; the default use is feeding
+// metrics and tracing backends (see the clusterinfo/metrics package).
+type LookupObserver interface {
+	// OnConnect is called after each dial attempt, successful or not.
+	OnConnect(addr string, err error, dur time.Duration)
+	// OnCommand is called after each Command round-trip, successful or
+	// not. cmdName is the nsq.Command's Name (e.g. "IDENTIFY", "LOOKUP").
+	// ctx is the context the round-trip ran under (as passed to
+	// CommandContext), so a tracing implementation can start its span as a
+	// child of the caller's span instead of a new root.
+	OnCommand(ctx context.Context, addr string, cmdName string, respSize int, err error, dur time.Duration)
+	// OnDisconnect is called whenever the underlying connection is closed.
+	// reason is bucketed into a small fixed set of categories (see
+	// disconnectCategory) rather than the raw error text, since it's
+	// commonly used as a metrics label (see metrics.PrometheusObserver)
+	// where per-connection detail like an address would blow up
+	// cardinality.
+	OnDisconnect(addr string, reason string)
 }
 
 // peerInfo contains metadata for a lookupPeer instance (and is JSON marshalable)
@@ -49,26 +130,170 @@ const (
 // newLookupPeer creates a new lookupPeer instance connecting to the supplied address.
 //
 // The supplied connectCallback will be called *every* time the instance connects.
-func NewLookupPeer(addr string, maxBodySize int64, l levellogger.Logger, connectCallback func(*LookupPeer)) *LookupPeer {
-	return &LookupPeer{
+func NewLookupPeer(addr string, maxBodySize int64, l levellogger.Logger, connectCallback func(*LookupPeer), opts ...LookupPeerOption) *LookupPeer {
+	lp := &LookupPeer{
 		l:               l,
 		addr:            addr,
 		state:           stateDisconnected,
 		maxBodySize:     maxBodySize,
 		connectCallback: connectCallback,
 	}
+	for _, opt := range opts {
+		opt(lp)
+	}
+	return lp
 }
 
 // Connect will Dial the specified address, with timeouts
 func (lp *LookupPeer) Connect() error {
+	return lp.ConnectContext(context.Background())
+}
+
+// ConnectContext is Connect, but the dial itself is cancellable via ctx (in
+// addition to the lookupTimeout fallback applied when ctx has no deadline).
+func (lp *LookupPeer) ConnectContext(ctx context.Context) error {
 	if lp.l != nil {
 		lp.l.Output(2, fmt.Sprintf("LOOKUP connecting to %s", lp.addr))
 	}
-	conn, err := net.DialTimeout("tcp", lp.addr, lookupTimeout)
+	dialer := net.Dialer{Timeout: lookupTimeout}
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", lp.addr)
+	if lp.observer != nil {
+		lp.observer.OnConnect(lp.addr, err, time.Since(start))
+	}
 	if err != nil {
 		return err
 	}
 	lp.conn = conn
+	lp.r = conn
+	lp.w = conn
+	return nil
+}
+
+// deadlineFrom returns ctx's deadline if it has one, otherwise the default
+// lookupTimeout measured from now.
+func deadlineFrom(ctx context.Context) time.Time {
+	if dl, ok := ctx.Deadline(); ok {
+		return dl
+	}
+	return time.Now().Add(lookupTimeout)
+}
+
+// watchdog forces lp.conn's deadline into the past as soon as ctx is done,
+// unblocking any in-progress Read/Write so CommandContext can return
+// ctx.Err() promptly instead of waiting out the full I/O deadline. Callers
+// must invoke the returned stop func once the operation completes.
+func (lp *LookupPeer) watchdog(ctx context.Context) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			if lp.conn != nil {
+				lp.conn.SetDeadline(time.Unix(1, 0))
+			}
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// identifyResponse captures the subset of nsqlookupd's IDENTIFY reply this
+// client acts on.
+type identifyResponse struct {
+	TLSv1  bool `json:"tls_v1"`
+	Snappy bool `json:"snappy"`
+}
+
+// negotiate announces this peer's TLS/Snappy capabilities to nsqlookupd via
+// an IDENTIFY frame and, for each capability the peer acknowledges, upgrades
+// the connection in place. It is a no-op if neither was configured.
+//
+// nsqlookupd's IDENTIFY handler rejects a payload missing
+// broadcast_address/tcp_port/http_port/version, so callers that want
+// TLS/Snappy negotiated must set lp.Info to this node's real identity
+// before connecting (the same fields nsqd's lookupLoop already sends).
+// If the peer doesn't ack — because it's an older nsqlookupd that doesn't
+// know feature_negotiation at all, or it rejected the IDENTIFY body for a
+// reason this client can't repair — negotiate treats that as "no upgrade"
+// rather than a fatal error, so an unmodified nsqlookupd is degraded to
+// plaintext/uncompressed instead of having its connection torn down.
+func (lp *LookupPeer) negotiate(ctx context.Context) error {
+	if lp.tlsConfig == nil && lp.compression == CompressionNone {
+		return nil
+	}
+	lp.conn.SetDeadline(deadlineFrom(ctx))
+
+	ident := make(map[string]interface{}, 7)
+	ident["feature_negotiation"] = true
+	ident["broadcast_address"] = lp.Info.BroadcastAddress
+	ident["tcp_port"] = lp.Info.TCPPort
+	ident["http_port"] = lp.Info.HTTPPort
+	ident["version"] = lp.Info.Version
+	if lp.tlsConfig != nil {
+		ident["tls_v1"] = true
+	}
+	if lp.compression == CompressionSnappy {
+		ident["snappy"] = true
+	}
+
+	cmd, err := nsq.Identify(ident)
+	if err != nil {
+		return err
+	}
+	if _, err := cmd.WriteTo(lp); err != nil {
+		return err
+	}
+	resp, err := readResponseBounded(lp, lp.maxBodySize)
+	if err != nil {
+		return err
+	}
+
+	var reply identifyResponse
+	if err := json.Unmarshal(resp, &reply); err != nil {
+		// Not a JSON IDENTIFY reply, so the peer either doesn't speak
+		// feature_negotiation or rejected the body (e.g. E_BAD_BODY, which
+		// isn't JSON either). Either way it's a declined upgrade, not a
+		// framing error on our side — keep the plain connection rather
+		// than closing it.
+		return nil
+	}
+
+	if lp.tlsConfig != nil && reply.TLSv1 {
+		conn := tls.Client(lp.conn, lp.tlsConfig)
+		if err := conn.Handshake(); err != nil {
+			return err
+		}
+		lp.conn = conn
+		lp.r = conn
+		lp.w = conn
+		if err := lp.readUpgradeOK(); err != nil {
+			return err
+		}
+	}
+
+	if lp.compression == CompressionSnappy && reply.Snappy {
+		lp.r = snappy.NewReader(lp.r)
+		lp.w = snappy.NewWriter(lp.w)
+		if err := lp.readUpgradeOK(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readUpgradeOK reads and validates the OK frame nsqlookupd sends after
+// each successful TLS/Snappy upgrade (mirroring go-nsq's upgradeTLS and
+// upgradeSnappy). Skipping this leaves that frame on the wire, desyncing
+// every response that follows by one.
+func (lp *LookupPeer) readUpgradeOK() error {
+	resp, err := readResponseBounded(lp, lp.maxBodySize)
+	if err != nil {
+		return err
+	}
+	if string(resp) != "OK" {
+		return fmt.Errorf("clusterinfo: expected OK after upgrade, got %q", resp)
+	}
 	return nil
 }
 
@@ -77,23 +302,135 @@ func (lp *LookupPeer) String() string {
 	return lp.addr
 }
 
-// Read implements the io.Reader interface, adding deadlines
+// Read implements the io.Reader interface.
+//
+// Unlike earlier versions, Read no longer resets the deadline on every
+// call; callers (ensureConnectedContext, negotiate, CommandContext) set a
+// deadline for the whole logical request up front via lp.conn.SetDeadline.
 func (lp *LookupPeer) Read(data []byte) (int, error) {
-	lp.conn.SetReadDeadline(time.Now().Add(lookupTimeout))
-	return lp.conn.Read(data)
+	return lp.r.Read(data)
 }
 
-// Write implements the io.Writer interface, adding deadlines
+// Write implements the io.Writer interface. See Read for the deadline note.
 func (lp *LookupPeer) Write(data []byte) (int, error) {
-	lp.conn.SetWriteDeadline(time.Now().Add(lookupTimeout))
-	return lp.conn.Write(data)
+	return lp.w.Write(data)
 }
 
 // Close implements the io.Closer interface
 func (lp *LookupPeer) Close() error {
+	return lp.closeWithReason("closed")
+}
+
+// closeWithReason is Close plus a reason forwarded to the observer (after
+// bucketing — see disconnectCategory), so error paths (write/read/negotiate
+// failure) can report something more useful than "closed".
+//
+// It also tears down the current async generation, if one exists: any
+// CommandAsync waiter still queued is failed and readLoop is woken so it
+// exits instead of blocking forever on an empty queue with nothing left to
+// unblock it. That matters specifically for a caller that Close()s directly
+// (e.g. a pool janitor eviction) while readLoop is idle between entries —
+// unlike a write/read error, a direct Close has no in-flight Read of its own
+// to interrupt.
+//
+// closeWithReason takes lp.mu internally, so it must never be called by a
+// caller that already holds it — use closeWithReasonLocked instead.
+func (lp *LookupPeer) closeWithReason(reason string) error {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return lp.closeWithReasonLocked(reason)
+}
+
+// closeWithReasonLocked is closeWithReason for a caller that already holds
+// lp.mu (CommandAsync's own write-then-enqueue critical section, and its
+// ensureConnectedLocked call). Every channel op it performs — failing a
+// queued waiter, waking readLoop — is a non-blocking or buffered-capacity-1
+// send, so none of it can stall while the lock is held.
+func (lp *LookupPeer) closeWithReasonLocked(reason string) error {
 	lp.state = stateDisconnected
-	if lp.conn != nil {
-		return lp.conn.Close()
+	async := lp.async
+	lp.async = nil
+	if async != nil {
+		items := async.items
+		async.items = nil
+		async.closed = true
+		for _, waiter := range items {
+			waiter.out <- Result{Err: errAsyncClosed}
+			close(waiter.out)
+		}
+		select {
+		case async.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	if lp.conn == nil {
+		return nil
+	}
+	err := lp.conn.Close()
+	if lp.observer != nil {
+		lp.observer.OnDisconnect(lp.addr, disconnectCategory(reason))
+	}
+	return err
+}
+
+// disconnectCategory maps a free-form close reason, which may embed
+// per-connection detail like an address or the underlying error text, down
+// to a small fixed set of values safe to use as a metrics label.
+func disconnectCategory(reason string) string {
+	switch {
+	case strings.HasPrefix(reason, "write failed"):
+		return "write_error"
+	case strings.HasPrefix(reason, "read failed"):
+		return "read_error"
+	case strings.HasPrefix(reason, "negotiate failed"):
+		return "negotiate_failed"
+	case reason == "closed":
+		return "closed"
+	default:
+		return "other"
+	}
+}
+
+// ensureConnected lazily dials and handshakes with nsqlookupd if the peer
+// isn't already connected, firing connectCallback on a fresh connection.
+func (lp *LookupPeer) ensureConnected() error {
+	return lp.ensureConnectedContext(context.Background())
+}
+
+// ensureConnectedContext is ensureConnected with ctx threaded through the
+// dial and the MagicV1/IDENTIFY handshake. Callers that don't already hold
+// lp.mu (Command, CommandPipeline) use this entry point.
+func (lp *LookupPeer) ensureConnectedContext(ctx context.Context) error {
+	return lp.ensureConnectedWith(ctx, lp.closeWithReason)
+}
+
+// ensureConnectedLocked is ensureConnectedContext for a caller that already
+// holds lp.mu (CommandAsync, which serializes connect attempts from
+// concurrent callers the same way it serializes writes).
+func (lp *LookupPeer) ensureConnectedLocked(ctx context.Context) error {
+	return lp.ensureConnectedWith(ctx, lp.closeWithReasonLocked)
+}
+
+// ensureConnectedWith is ensureConnectedContext's shared core; close is
+// closeWithReason or closeWithReasonLocked depending on whether the caller
+// already holds lp.mu.
+func (lp *LookupPeer) ensureConnectedWith(ctx context.Context, close func(string) error) error {
+	if lp.state == stateConnected {
+		return nil
+	}
+	if err := lp.ConnectContext(ctx); err != nil {
+		return err
+	}
+	lp.state = stateConnected
+	lp.conn.SetDeadline(deadlineFrom(ctx))
+	lp.Write(nsq.MagicV1)
+	if err := lp.negotiate(ctx); err != nil {
+		close("negotiate failed: " + err.Error())
+		return err
+	}
+	if lp.connectCallback != nil {
+		lp.connectCallback(lp)
 	}
 	return nil
 }
@@ -103,36 +440,66 @@ func (lp *LookupPeer) Close() error {
 // It will lazily connect to nsqlookupd and gracefully handle
 // reconnecting in the event of a failure.
 //
-// It returns the response from nsqlookupd as []byte
+// It returns the response from nsqlookupd as []byte. It is equivalent to
+// CommandContext(context.Background(), cmd).
 func (lp *LookupPeer) Command(cmd *nsq.Command) ([]byte, error) {
-	initialState := lp.state
-	if lp.state != stateConnected {
-		err := lp.Connect()
-		if err != nil {
-			return nil, err
-		}
-		lp.state = stateConnected
-		lp.Write(nsq.MagicV1)
-		if initialState == stateDisconnected {
-			lp.connectCallback(lp)
-		}
+	return lp.CommandContext(context.Background(), cmd)
+}
+
+// CommandContext is Command with a per-call deadline and cancellation: the
+// deadline comes from ctx (falling back to the package's lookupTimeout
+// default), and a watchdog forces the in-progress Read/Write to unblock as
+// soon as ctx is done, so a caller whose own client has already
+// disconnected can cancel an in-flight LOOKUP instead of waiting it out.
+func (lp *LookupPeer) CommandContext(ctx context.Context, cmd *nsq.Command) ([]byte, error) {
+	if err := lp.ensureConnectedContext(ctx); err != nil {
+		return nil, err
 	}
 	if cmd == nil {
 		return nil, nil
 	}
+
+	stop := lp.watchdog(ctx)
+	defer stop()
+
+	lp.conn.SetDeadline(deadlineFrom(ctx))
+
+	start := time.Now()
 	_, err := cmd.WriteTo(lp)
 	if err != nil {
-		lp.Close()
-		return nil, err
+		lp.closeWithReason("write failed: " + err.Error())
+		lp.observeCommand(ctx, cmd, 0, err, start)
+		return nil, ctxOrErr(ctx, err)
 	}
 	resp, err := readResponseBounded(lp, lp.maxBodySize)
 	if err != nil {
-		lp.Close()
-		return nil, err
+		lp.closeWithReason("read failed: " + err.Error())
+		lp.observeCommand(ctx, cmd, 0, err, start)
+		return nil, ctxOrErr(ctx, err)
 	}
+	lp.observeCommand(ctx, cmd, len(resp), nil, start)
 	return resp, nil
 }
 
+// ctxOrErr prefers ctx.Err() over err, since a watchdog-forced deadline
+// surfaces as a generic i/o timeout that's less useful to the caller than
+// the cancellation/deadline reason that caused it.
+func ctxOrErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// observeCommand reports a completed Command round-trip to the configured
+// LookupObserver, if any.
+func (lp *LookupPeer) observeCommand(ctx context.Context, cmd *nsq.Command, respSize int, err error, start time.Time) {
+	if lp.observer == nil {
+		return
+	}
+	lp.observer.OnCommand(ctx, lp.addr, string(cmd.Name), respSize, err, time.Since(start))
+}
+
 func readResponseBounded(r io.Reader, limit int64) ([]byte, error) {
 	var msgSize int32
 
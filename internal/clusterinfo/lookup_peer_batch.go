@@ -0,0 +1,226 @@
+package clusterinfo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/youzan/go-nsq"
+)
+
+// CommandPipeline writes cmds back-to-back on a single connection and then
+// reads len(cmds) length-prefixed responses in order, sharing one
+// connect/handshake instead of paying a round-trip per command.
+//
+// Errors are isolated per response: an application-level error reply (e.g.
+// E_BAD_TOPIC) is returned as a normal []byte body with no entry in the
+// error slice, matching Command. Only an I/O failure — a write error, a
+// framing error or a short read, which leave the connection in an unknown
+// state — closes the socket and fills every remaining error slot with that
+// error.
+func (lp *LookupPeer) CommandPipeline(cmds []*nsq.Command) ([][]byte, []error) {
+	resps := make([][]byte, len(cmds))
+	errs := make([]error, len(cmds))
+
+	if err := lp.ensureConnected(); err != nil {
+		fillErr(errs, 0, err)
+		return resps, errs
+	}
+	lp.conn.SetDeadline(deadlineFrom(context.Background()))
+
+	for i, cmd := range cmds {
+		if cmd == nil {
+			continue
+		}
+		if _, err := cmd.WriteTo(lp); err != nil {
+			lp.Close()
+			fillErr(errs, i, err)
+			return resps, errs
+		}
+	}
+
+	for i, cmd := range cmds {
+		if cmd == nil {
+			continue
+		}
+		resp, err := readResponseBounded(lp, lp.maxBodySize)
+		if err != nil {
+			lp.Close()
+			fillErr(errs, i, err)
+			return resps, errs
+		}
+		resps[i] = resp
+	}
+
+	return resps, errs
+}
+
+func fillErr(errs []error, from int, err error) {
+	for i := from; i < len(errs); i++ {
+		errs[i] = err
+	}
+}
+
+// Result is the outcome of an asynchronous Command issued via CommandAsync.
+type Result struct {
+	Resp []byte
+	Err  error
+}
+
+// errAsyncClosed is the error handed to any CommandAsync waiter still
+// queued when the connection is closed out from under it without a read or
+// write error of its own (e.g. a direct Close by a pool janitor).
+var errAsyncClosed = errors.New("clusterinfo: lookup peer closed")
+
+// asyncPending couples a waiter's result channel with the read deadline
+// that applied when its command was written, so the decoupled readLoop
+// goroutine can apply the right deadline to the right response instead of
+// racing writers over a single shared conn deadline.
+type asyncPending struct {
+	out      chan Result
+	deadline time.Time
+}
+
+// asyncQueue is the FIFO of outstanding CommandAsync waiters for one
+// generation of lp.conn, plus the plumbing readLoop needs to sleep when it's
+// empty instead of busy-polling.
+//
+// items and closed are guarded by the owning LookupPeer's mu, not a lock of
+// their own: CommandAsync must append under the very same lock it uses to
+// serialize writes, or two concurrent writers could land on the wire in one
+// order and on the queue in another. wake is a capacity-1 non-blocking
+// signal: a send never blocks a writer, and readers always re-check
+// items/closed under the lock after waking, so a signal sent while the
+// reader is already awake is never lost.
+type asyncQueue struct {
+	items  []*asyncPending
+	closed bool
+	wake   chan struct{}
+}
+
+// CommandAsync queues cmd for a round-trip and returns immediately with a
+// channel that receives the single Result once it's read back. Multiple
+// goroutines may call CommandAsync on the same LookupPeer concurrently:
+// writes are serialized and a single background reader goroutine drains
+// responses in FIFO order, matching the order commands were written.
+func (lp *LookupPeer) CommandAsync(cmd *nsq.Command) <-chan Result {
+	out := make(chan Result, 1)
+
+	lp.mu.Lock()
+
+	// Connecting happens under the same lock as the write+enqueue below,
+	// same as the original design: without it, concurrent first-time
+	// CommandAsync callers would each see the peer disconnected and race
+	// to dial/negotiate independently. ensureConnectedLocked uses
+	// closeWithReasonLocked on a negotiate failure so this doesn't
+	// deadlock against the lock we're already holding.
+	if err := lp.ensureConnectedLocked(context.Background()); err != nil {
+		lp.mu.Unlock()
+		out <- Result{Err: err}
+		close(out)
+		return out
+	}
+
+	if lp.async == nil {
+		async := &asyncQueue{wake: make(chan struct{}, 1)}
+		lp.async = async
+		go lp.readLoop(async)
+	}
+	async := lp.async
+
+	deadline := deadlineFrom(context.Background())
+	lp.conn.SetWriteDeadline(deadline)
+	if _, err := cmd.WriteTo(lp); err != nil {
+		lp.closeWithReasonLocked("write failed: " + err.Error())
+		lp.mu.Unlock()
+		out <- Result{Err: err}
+		close(out)
+		return out
+	}
+
+	// The write and the enqueue happen in the same critical section: a
+	// second CommandAsync call can't land its own write on the wire
+	// between this one's write and its own enqueue, so wire order and
+	// queue order can never diverge.
+	async.items = append(async.items, &asyncPending{out: out, deadline: deadline})
+	lp.mu.Unlock()
+
+	select {
+	case async.wake <- struct{}{}:
+	default:
+	}
+	return out
+}
+
+// readLoop is the single reader for a LookupPeer once CommandAsync is in
+// use. It hands each response to the next waiter in FIFO order, applying
+// that waiter's own deadline rather than whatever deadline the conn was
+// last left with by a writer. On a framing/read error it closes the
+// connection, fails every request still queued, and exits; the next
+// CommandAsync call reconnects and starts a fresh readLoop.
+func (lp *LookupPeer) readLoop(async *asyncQueue) {
+	for {
+		waiter, ok := lp.nextAsyncWaiter(async)
+		if !ok {
+			return
+		}
+		lp.conn.SetReadDeadline(waiter.deadline)
+		resp, err := readResponseBounded(lp, lp.maxBodySize)
+		waiter.out <- Result{Resp: resp, Err: err}
+		close(waiter.out)
+		if err != nil {
+			lp.detachAsync(async, err)
+			lp.closeWithReason("read failed: " + err.Error())
+			return
+		}
+	}
+}
+
+// nextAsyncWaiter pops the next queued waiter for async, blocking until one
+// arrives if the queue is empty. It reports ok=false once async has been
+// closed (by detachAsync, via a read error or via closeWithReason) and
+// drained, telling readLoop to exit rather than block forever.
+func (lp *LookupPeer) nextAsyncWaiter(async *asyncQueue) (waiter *asyncPending, ok bool) {
+	for {
+		lp.mu.Lock()
+		if len(async.items) > 0 {
+			waiter = async.items[0]
+			async.items = async.items[1:]
+			lp.mu.Unlock()
+			return waiter, true
+		}
+		if async.closed {
+			lp.mu.Unlock()
+			return nil, false
+		}
+		lp.mu.Unlock()
+		<-async.wake
+	}
+}
+
+// detachAsync disconnects async as lp's current generation (if it still is
+// one) and fails every waiter left queued, then wakes readLoop so an
+// otherwise-idle one exits instead of blocking on an empty queue with
+// nothing left to unblock it. It's called from readLoop's own read-error
+// teardown; closeWithReasonLocked performs the same teardown inline, so a
+// direct Close (e.g. a pool janitor eviction) during an idle readLoop is
+// handled the same way a read error is.
+func (lp *LookupPeer) detachAsync(async *asyncQueue, err error) {
+	lp.mu.Lock()
+	items := async.items
+	async.items = nil
+	async.closed = true
+	if lp.async == async {
+		lp.async = nil
+	}
+	lp.mu.Unlock()
+
+	for _, waiter := range items {
+		waiter.out <- Result{Err: err}
+		close(waiter.out)
+	}
+	select {
+	case async.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,176 @@
+package clusterinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/youzan/go-nsq"
+)
+
+// TestCommandPipelineIsolatesApplicationErrors verifies that an
+// application-level error reply (e.g. E_BAD_TOPIC) in the middle of a
+// pipelined batch is returned as a normal body with no entry in the error
+// slice, and doesn't stop the remaining responses from being read off the
+// same connection.
+func TestCommandPipelineIsolatesApplicationErrors(t *testing.T) {
+	bodies := [][]byte{[]byte("OK"), []byte("E_BAD_TOPIC bad topic"), []byte("OK")}
+	addr, stop := newFakeLookupd(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for range bodies {
+			if _, _, err := readCommandLine(r); err != nil {
+				return
+			}
+		}
+		for _, body := range bodies {
+			if err := writeFrame(conn, body); err != nil {
+				return
+			}
+		}
+	})
+	defer stop()
+
+	lp := NewLookupPeer(addr, 4096, nil, nil)
+	defer lp.Close()
+
+	cmds := []*nsq.Command{nsq.Ping(), nsq.Ping(), nsq.Ping()}
+	resps, errs := lp.CommandPipeline(cmds)
+
+	for i, body := range bodies {
+		if errs[i] != nil {
+			t.Fatalf("resp[%d]: unexpected error %v", i, errs[i])
+		}
+		if string(resps[i]) != string(body) {
+			t.Fatalf("resp[%d]: got %q, want %q", i, resps[i], body)
+		}
+	}
+}
+
+// TestCommandPipelineFramingErrorAbortsRemaining verifies that a framing
+// error (a response frame that doesn't fit the announced length) closes the
+// connection and fails every response from that point on, rather than
+// silently desyncing the rest of the batch.
+func TestCommandPipelineFramingErrorAbortsRemaining(t *testing.T) {
+	addr, stop := newFakeLookupd(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for i := 0; i < 3; i++ {
+			if _, _, err := readCommandLine(r); err != nil {
+				return
+			}
+		}
+		writeFrame(conn, []byte("OK"))
+		// Announce a body longer than what's actually sent, then close:
+		// a short read the client can't recover from.
+		var hdr [4]byte
+		hdr[3] = 100
+		conn.Write(hdr[:])
+		conn.Write([]byte("short"))
+	})
+	defer stop()
+
+	lp := NewLookupPeer(addr, 4096, nil, nil)
+	defer lp.Close()
+
+	cmds := []*nsq.Command{nsq.Ping(), nsq.Ping(), nsq.Ping()}
+	resps, errs := lp.CommandPipeline(cmds)
+
+	if errs[0] != nil || string(resps[0]) != "OK" {
+		t.Fatalf("resp[0]: got resp=%q err=%v, want \"OK\", nil", resps[0], errs[0])
+	}
+	if errs[1] == nil {
+		t.Fatal("resp[1]: expected a framing error")
+	}
+	if errs[2] != errs[1] {
+		t.Fatalf("resp[2]: expected the same framing error to fill the remaining slot, got %v", errs[2])
+	}
+}
+
+// TestCommandAsyncOrdersResponsesByRequest exercises CommandAsync from many
+// concurrent goroutines sharing one LookupPeer, verifying readLoop hands
+// each response back to the caller that actually issued the matching
+// request rather than mismatching queue position against wire order.
+func TestCommandAsyncOrdersResponsesByRequest(t *testing.T) {
+	const n = 50
+	addr, stop := newFakeLookupd(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for i := 0; i < n; i++ {
+			_, params, err := readCommandLine(r)
+			if err != nil || len(params) == 0 {
+				return
+			}
+			if err := writeFrame(conn, []byte(params[0])); err != nil {
+				return
+			}
+		}
+	})
+	defer stop()
+
+	lp := NewLookupPeer(addr, 4096, nil, nil)
+	defer lp.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("id-%d", i)
+			cmd := &nsq.Command{Name: []byte("PING"), Params: [][]byte{[]byte(id)}}
+			res := <-lp.CommandAsync(cmd)
+			if res.Err != nil {
+				t.Errorf("id %s: unexpected error %v", id, res.Err)
+				return
+			}
+			if string(res.Resp) != id {
+				t.Errorf("id %s: got response %q, want the echoed id", id, res.Resp)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// TestCloseUnblocksIdleReadLoop verifies that Close (e.g. a pool janitor
+// evicting a peer between uses) wakes readLoop even when it's parked with an
+// empty queue and nothing in flight — unlike a write/read error, a direct
+// Close doesn't have a blocked conn Read of its own to interrupt, so without
+// an explicit wake readLoop would block on the empty queue forever.
+func TestCloseUnblocksIdleReadLoop(t *testing.T) {
+	addr, stop := newFakeLookupd(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		if _, _, err := readCommandLine(r); err != nil {
+			return
+		}
+		writeFrame(conn, []byte("OK"))
+		// Go idle after the one response: nothing left to unblock a
+		// parked readLoop until the client closes the connection.
+		io.Copy(io.Discard, conn)
+	})
+	defer stop()
+
+	lp := NewLookupPeer(addr, 4096, nil, nil)
+	before := runtime.NumGoroutine()
+
+	res := <-lp.CommandAsync(nsq.Ping())
+	if res.Err != nil {
+		t.Fatalf("unexpected error: %v", res.Err)
+	}
+	// Give readLoop a moment to loop back around and park on its wake
+	// channel with an empty queue.
+	time.Sleep(50 * time.Millisecond)
+
+	if err := lp.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("readLoop still running a second after Close with an idle queue (goroutines: %d, started with %d)", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
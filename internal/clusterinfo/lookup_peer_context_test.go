@@ -0,0 +1,77 @@
+package clusterinfo
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/youzan/go-nsq"
+)
+
+// TestCommandContextCancellationUnblocksRead verifies that canceling ctx
+// unblocks an in-flight CommandContext promptly, via the watchdog forcing
+// the conn's deadline into the past, instead of waiting out the full
+// lookupTimeout default.
+func TestCommandContextCancellationUnblocksRead(t *testing.T) {
+	addr, stop := newFakeLookupd(t, func(conn net.Conn) {
+		// Accept the command but never respond, simulating a wedged
+		// nsqlookupd whose caller has since given up.
+		readCommandLine(bufio.NewReader(conn))
+		// Never respond; block until the client side closes, at which
+		// point this Read returns and the connection is cleaned up.
+		io.Copy(io.Discard, conn)
+	})
+	defer stop()
+
+	lp := NewLookupPeer(addr, 4096, nil, nil)
+	defer lp.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := lp.CommandContext(ctx, nsq.Ping())
+	elapsed := time.Since(start)
+
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if elapsed > time.Second {
+		t.Fatalf("CommandContext took %s to unblock after cancellation, expected it to return promptly", elapsed)
+	}
+}
+
+// TestCommandContextDeadlineUnblocksRead is the same as
+// TestCommandContextCancellationUnblocksRead but via a context deadline
+// instead of an explicit cancel, matching an HTTP handler whose own
+// request context expires.
+func TestCommandContextDeadlineUnblocksRead(t *testing.T) {
+	addr, stop := newFakeLookupd(t, func(conn net.Conn) {
+		readCommandLine(bufio.NewReader(conn))
+		io.Copy(io.Discard, conn)
+	})
+	defer stop()
+
+	lp := NewLookupPeer(addr, 4096, nil, nil)
+	defer lp.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := lp.CommandContext(ctx, nsq.Ping())
+	elapsed := time.Since(start)
+
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed > time.Second {
+		t.Fatalf("CommandContext took %s to unblock after its deadline, expected it to return promptly", elapsed)
+	}
+}
@@ -0,0 +1,194 @@
+package clusterinfo
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/youzan/go-nsq"
+)
+
+// generateSelfSignedCert builds a throwaway TLS certificate for 127.0.0.1,
+// good enough for a fake server the client connects to with
+// InsecureSkipVerify.
+func generateSelfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// readIdentify reads and parses the IDENTIFY command negotiate sends,
+// returning its JSON body.
+func readIdentify(t *testing.T, r *bufio.Reader, conn net.Conn) map[string]interface{} {
+	t.Helper()
+	name, _, err := readCommandLine(r)
+	if err != nil {
+		t.Fatalf("read IDENTIFY line: %v", err)
+	}
+	if name != "IDENTIFY" {
+		t.Fatalf("got command %q, want IDENTIFY", name)
+	}
+	body, err := readResponseBounded(r, 1<<20)
+	if err != nil {
+		t.Fatalf("read IDENTIFY body: %v", err)
+	}
+	var ident map[string]interface{}
+	if err := json.Unmarshal(body, &ident); err != nil {
+		t.Fatalf("unmarshal IDENTIFY body: %v", err)
+	}
+	return ident
+}
+
+// TestNegotiateUpgradesSnappyAndConsumesOKFrame verifies that when
+// nsqlookupd acks snappy, negotiate wraps the connection in a snappy
+// reader/writer and consumes the OK frame that follows the upgrade, rather
+// than leaving it on the wire to desync the next response.
+func TestNegotiateUpgradesSnappyAndConsumesOKFrame(t *testing.T) {
+	addr, stop := newFakeLookupd(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		readIdentify(t, r, conn)
+		if err := writeFrame(conn, []byte(`{"snappy":true}`)); err != nil {
+			return
+		}
+
+		// From here on, both sides speak snappy.
+		sw := snappy.NewWriter(conn)
+		sr := bufio.NewReader(snappy.NewReader(r))
+		if err := writeFrame(sw, []byte("OK")); err != nil {
+			return
+		}
+		if err := sw.Flush(); err != nil {
+			return
+		}
+
+		// Prove the connection is still usable post-upgrade: answer one
+		// more command through the same snappy-wrapped streams.
+		if _, _, err := readCommandLine(sr); err != nil {
+			return
+		}
+		writeFrame(sw, []byte("PONG"))
+		sw.Flush()
+	})
+	defer stop()
+
+	lp := NewLookupPeer(addr, 4096, nil, nil, WithCompression(CompressionSnappy))
+	lp.Info = peerInfo{BroadcastAddress: "127.0.0.1", TCPPort: 4150, HTTPPort: 4151, Version: "1.0.0"}
+	defer lp.Close()
+
+	resp, err := lp.Command(nsq.Ping())
+	if err != nil {
+		t.Fatalf("Command after snappy upgrade: %v", err)
+	}
+	if string(resp) != "PONG" {
+		t.Fatalf("got response %q, want PONG", resp)
+	}
+}
+
+// TestNegotiateUpgradesTLSAndConsumesOKFrame is the TLS equivalent of
+// TestNegotiateUpgradesSnappyAndConsumesOKFrame: nsqlookupd acks tls_v1,
+// both sides complete a TLS handshake, and negotiate consumes the OK frame
+// sent over the now-encrypted connection before the caller's own command
+// round-trip runs.
+func TestNegotiateUpgradesTLSAndConsumesOKFrame(t *testing.T) {
+	cert := generateSelfSignedCert(t)
+	addr, stop := newFakeLookupd(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		readIdentify(t, r, conn)
+		if err := writeFrame(conn, []byte(`{"tls_v1":true}`)); err != nil {
+			return
+		}
+
+		tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Errorf("server TLS handshake: %v", err)
+			return
+		}
+		if err := writeFrame(tlsConn, []byte("OK")); err != nil {
+			return
+		}
+
+		tr := bufio.NewReader(tlsConn)
+		if _, _, err := readCommandLine(tr); err != nil {
+			return
+		}
+		writeFrame(tlsConn, []byte("PONG"))
+	})
+	defer stop()
+
+	lp := NewLookupPeer(addr, 4096, nil, nil, WithTLSConfig(&tls.Config{InsecureSkipVerify: true}))
+	lp.Info = peerInfo{BroadcastAddress: "127.0.0.1", TCPPort: 4150, HTTPPort: 4151, Version: "1.0.0"}
+	defer lp.Close()
+
+	resp, err := lp.Command(nsq.Ping())
+	if err != nil {
+		t.Fatalf("Command after TLS upgrade: %v", err)
+	}
+	if string(resp) != "PONG" {
+		t.Fatalf("got response %q, want PONG", resp)
+	}
+}
+
+// TestNegotiateDegradesWhenPeerDoesNotAck verifies that an nsqlookupd which
+// doesn't acknowledge tls_v1/snappy (an older version, or one that rejected
+// the IDENTIFY body) leaves the connection plaintext and uncompressed
+// rather than tearing it down — negotiate treats a declined upgrade as
+// success, not an error.
+func TestNegotiateDegradesWhenPeerDoesNotAck(t *testing.T) {
+	addr, stop := newFakeLookupd(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		readIdentify(t, r, conn)
+		// An older nsqlookupd: responds E_BAD_BODY, which isn't JSON.
+		if err := writeFrame(conn, []byte("E_BAD_BODY unrecognized param")); err != nil {
+			return
+		}
+
+		// No upgrade on either side; prove the connection still works
+		// plaintext.
+		if _, _, err := readCommandLine(r); err != nil {
+			return
+		}
+		writeFrame(conn, []byte("PONG"))
+	})
+	defer stop()
+
+	lp := NewLookupPeer(addr, 4096, nil, nil,
+		WithTLSConfig(&tls.Config{InsecureSkipVerify: true}),
+		WithCompression(CompressionSnappy),
+	)
+	lp.Info = peerInfo{BroadcastAddress: "127.0.0.1", TCPPort: 4150, HTTPPort: 4151, Version: "1.0.0"}
+	defer lp.Close()
+
+	resp, err := lp.Command(nsq.Ping())
+	if err != nil {
+		t.Fatalf("Command after declined upgrade: %v", err)
+	}
+	if string(resp) != "PONG" {
+		t.Fatalf("got response %q, want PONG", resp)
+	}
+}
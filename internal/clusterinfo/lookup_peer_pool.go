@@ -0,0 +1,311 @@
+package clusterinfo
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/youzan/go-nsq"
+	"github.com/youzan/nsq/internal/levellogger"
+)
+
+// ErrPoolClosed is returned by Get/Command once the owning LookupPeerPool
+// has been closed.
+var ErrPoolClosed = errors.New("clusterinfo: lookup peer pool is closed")
+
+// pingCommand is a no-op round-trip used by the pool janitor to detect
+// stale connections without disturbing caller traffic.
+var pingCommand = &nsq.Command{Name: []byte("PING")}
+
+// LookupPeerPoolConfig controls the sizing and lifecycle of a LookupPeerPool.
+type LookupPeerPoolConfig struct {
+	// InitialCap is the number of connections eagerly dialed when the pool
+	// is created.
+	InitialCap int
+	// MaxCap is the maximum number of connections the pool will open to
+	// addr. Get blocks (respecting ctx) once MaxCap is reached and all
+	// connections are checked out.
+	MaxCap int
+	// MaxBodySize bounds the response size accepted from addr, passed
+	// through to each underlying LookupPeer.
+	MaxBodySize int64
+	// PingInterval, when non-zero, causes the pool to probe one idle
+	// connection at a time with a no-op command and evict it if the probe
+	// fails. Zero disables the janitor.
+	PingInterval time.Duration
+	// ConnectCallback is invoked, per underlying socket, the first time it
+	// connects (mirrors NewLookupPeer's connectCallback).
+	ConnectCallback func(*LookupPeer)
+	// TLSConfig, when set, is passed to WithTLSConfig for every connection
+	// the pool dials.
+	TLSConfig *tls.Config
+	// Compression, when set, is passed to WithCompression for every
+	// connection the pool dials.
+	Compression Compression
+	// Observer, when set, is passed to WithObserver for every connection
+	// the pool dials.
+	Observer LookupObserver
+}
+
+// LookupPeerPool maintains a bounded set of healthy *LookupPeer connections
+// to a single nsqlookupd address, so concurrent callers (nsqd's lookupLoop,
+// nsqadmin's cluster queries) can issue IDENTIFY/REGISTER/NOTIFY/LOOKUP
+// round-trips without serializing on one socket.
+type LookupPeerPool struct {
+	l    levellogger.Logger
+	addr string
+	cfg  LookupPeerPoolConfig
+
+	mtx     sync.Mutex
+	conns   chan *pooledPeer
+	numOpen int
+	closed  bool
+	stopCh  chan struct{}
+}
+
+// pooledPeer wraps a LookupPeer with the "unusable" flag that Command sets
+// on I/O failure, so Put knows to discard rather than recycle it.
+type pooledPeer struct {
+	*LookupPeer
+	unusable bool
+}
+
+// MarkUnusable flags the connection as broken. A subsequent Put discards it
+// instead of returning it to the pool.
+func (p *pooledPeer) MarkUnusable() {
+	p.unusable = true
+}
+
+// Command shadows the embedded LookupPeer.Command so that any I/O error
+// marks this pooledPeer unusable, regardless of whether the caller went
+// through the pool's own Command convenience method or used Get/Put
+// directly. Without this override, a Get/Put caller's failed round-trip
+// would leave a now-broken connection to be silently reused.
+func (p *pooledPeer) Command(cmd *nsq.Command) ([]byte, error) {
+	resp, err := p.LookupPeer.Command(cmd)
+	if err != nil {
+		p.unusable = true
+	}
+	return resp, err
+}
+
+// CommandContext is Command with ctx threaded through; see Command for why
+// it's overridden here rather than left as the embedded LookupPeer method.
+func (p *pooledPeer) CommandContext(ctx context.Context, cmd *nsq.Command) ([]byte, error) {
+	resp, err := p.LookupPeer.CommandContext(ctx, cmd)
+	if err != nil {
+		p.unusable = true
+	}
+	return resp, err
+}
+
+// NewLookupPeerPool creates a LookupPeerPool for addr and eagerly dials
+// cfg.InitialCap connections.
+func NewLookupPeerPool(addr string, l levellogger.Logger, cfg LookupPeerPoolConfig) (*LookupPeerPool, error) {
+	if cfg.MaxCap <= 0 {
+		return nil, errors.New("clusterinfo: MaxCap must be greater than zero")
+	}
+	if cfg.InitialCap < 0 || cfg.InitialCap > cfg.MaxCap {
+		return nil, errors.New("clusterinfo: InitialCap must be between 0 and MaxCap")
+	}
+
+	p := &LookupPeerPool{
+		l:      l,
+		addr:   addr,
+		cfg:    cfg,
+		conns:  make(chan *pooledPeer, cfg.MaxCap),
+		stopCh: make(chan struct{}),
+	}
+
+	for i := 0; i < cfg.InitialCap; i++ {
+		peer, err := p.dial()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.numOpen++
+		p.conns <- peer
+	}
+
+	if cfg.PingInterval > 0 {
+		go p.janitor()
+	}
+
+	return p, nil
+}
+
+// dial creates a new LookupPeer and performs the MagicV1 handshake (and
+// fires ConnectCallback). Callers must have already reserved the slot
+// against numOpen (see Get) since dial itself does a blocking network round
+// trip and must not be called under p.mtx.
+func (p *LookupPeerPool) dial() (*pooledPeer, error) {
+	var opts []LookupPeerOption
+	if p.cfg.TLSConfig != nil {
+		opts = append(opts, WithTLSConfig(p.cfg.TLSConfig))
+	}
+	if p.cfg.Compression != CompressionNone {
+		opts = append(opts, WithCompression(p.cfg.Compression))
+	}
+	if p.cfg.Observer != nil {
+		opts = append(opts, WithObserver(p.cfg.Observer))
+	}
+
+	peer := NewLookupPeer(p.addr, p.cfg.MaxBodySize, p.l, p.cfg.ConnectCallback, opts...)
+	if _, err := peer.Command(nil); err != nil {
+		return nil, err
+	}
+	return &pooledPeer{LookupPeer: peer}, nil
+}
+
+// Get acquires a healthy connection, lazily dialing one if the pool has not
+// yet reached MaxCap, or blocking until one is returned or ctx is done.
+//
+// The slot is reserved against numOpen under p.mtx and released again on a
+// failed dial, but the dial itself (a blocking TCP connect plus MagicV1/
+// IDENTIFY handshake) runs unlocked, so concurrent Get calls that each need
+// to open a fresh connection do so in parallel instead of queuing behind
+// whichever caller dialed first.
+func (p *LookupPeerPool) Get(ctx context.Context) (*pooledPeer, error) {
+	p.mtx.Lock()
+	if p.closed {
+		p.mtx.Unlock()
+		return nil, ErrPoolClosed
+	}
+
+	select {
+	case peer := <-p.conns:
+		p.mtx.Unlock()
+		return peer, nil
+	default:
+	}
+
+	if p.numOpen < p.cfg.MaxCap {
+		p.numOpen++
+		p.mtx.Unlock()
+
+		peer, err := p.dial()
+		if err != nil {
+			p.mtx.Lock()
+			p.numOpen--
+			p.mtx.Unlock()
+			return nil, err
+		}
+		return peer, nil
+	}
+	p.mtx.Unlock()
+
+	select {
+	case peer := <-p.conns:
+		return peer, nil
+	case <-p.stopCh:
+		return nil, ErrPoolClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Put returns peer to the pool, discarding it (and any underlying socket)
+// if it was marked unusable, if the pool is closed, or if the pool is
+// already at capacity.
+func (p *LookupPeerPool) Put(peer *pooledPeer) {
+	if peer == nil {
+		return
+	}
+
+	p.mtx.Lock()
+	if p.closed || peer.unusable {
+		p.mtx.Unlock()
+		p.discard(peer)
+		return
+	}
+
+	select {
+	case p.conns <- peer:
+		p.mtx.Unlock()
+	default:
+		p.mtx.Unlock()
+		p.discard(peer)
+	}
+}
+
+// discard closes peer's underlying connection and reclaims its slot.
+func (p *LookupPeerPool) discard(peer *pooledPeer) {
+	peer.Close()
+	p.mtx.Lock()
+	p.numOpen--
+	p.mtx.Unlock()
+}
+
+// Command acquires a connection, performs the round-trip, and returns the
+// connection to the pool (discarding it first if the command failed; see
+// pooledPeer.Command for how that's tracked).
+func (p *LookupPeerPool) Command(ctx context.Context, cmd *nsq.Command) ([]byte, error) {
+	peer, err := p.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := peer.Command(cmd)
+	p.Put(peer)
+	return resp, err
+}
+
+// janitor periodically probes one idle connection with a no-op command and
+// evicts it if the probe fails, preventing nsqlookupd-side idle timeouts
+// from surfacing as errors on the next real caller.
+func (p *LookupPeerPool) janitor() {
+	ticker := time.NewTicker(p.cfg.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.probeOne()
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+func (p *LookupPeerPool) probeOne() {
+	var peer *pooledPeer
+	select {
+	case peer = <-p.conns:
+	default:
+		return
+	}
+
+	if _, err := peer.Command(pingCommand); err != nil {
+		if p.l != nil {
+			p.l.Output(2, fmt.Sprintf("LOOKUP pool %s: evicting stale connection: %s", p.addr, err))
+		}
+		p.discard(peer)
+		return
+	}
+	p.Put(peer)
+}
+
+// Close stops the janitor and closes every idle connection. Connections
+// currently checked out are closed as they're returned via Put.
+func (p *LookupPeerPool) Close() error {
+	p.mtx.Lock()
+	if p.closed {
+		p.mtx.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mtx.Unlock()
+
+	close(p.stopCh)
+	for {
+		select {
+		case peer := <-p.conns:
+			peer.Close()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package clusterinfo
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/youzan/go-nsq"
+)
+
+// newFakeLookupd starts a minimal nsqlookupd stand-in on 127.0.0.1: it reads
+// the MagicV1 handshake off each accepted connection and then hands the
+// connection to handle, which is responsible for reading commands and
+// writing length-prefixed responses per readResponseBounded's framing.
+func newFakeLookupd(t *testing.T, handle func(net.Conn)) (addr string, stop func()) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				magic := make([]byte, len(nsq.MagicV1))
+				if _, err := io.ReadFull(conn, magic); err != nil {
+					return
+				}
+				handle(conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+// readCommandLine reads a single newline-terminated command line as written
+// by nsq.Command.WriteTo, splitting it into the command name and params.
+func readCommandLine(r *bufio.Reader) (name string, params []string, err error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil, nil
+	}
+	return fields[0], fields[1:], nil
+}
+
+// writeFrame writes body as a length-prefixed response frame matching what
+// readResponseBounded expects.
+func writeFrame(w io.Writer, body []byte) error {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(body)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// TestLookupPeerPoolEvictsOnCommandError exercises the Get/Put pattern
+// directly (rather than the pool's own Command convenience method) and
+// verifies a peer whose Command fails due to an I/O error is discarded
+// instead of being recycled, per pooledPeer.Command/CommandContext marking
+// themselves unusable on any error regardless of call path.
+func TestLookupPeerPoolEvictsOnCommandError(t *testing.T) {
+	var accepts int32
+	addr, stop := newFakeLookupd(t, func(conn net.Conn) {
+		atomic.AddInt32(&accepts, 1)
+		r := bufio.NewReader(conn)
+		// Read the command and then drop the connection instead of
+		// responding, simulating a mid-command I/O failure.
+		readCommandLine(r)
+	})
+	defer stop()
+
+	pool, err := NewLookupPeerPool(addr, nil, LookupPeerPoolConfig{
+		InitialCap:  1,
+		MaxCap:      2,
+		MaxBodySize: 1024,
+	})
+	if err != nil {
+		t.Fatalf("NewLookupPeerPool: %v", err)
+	}
+	defer pool.Close()
+
+	ctx := context.Background()
+	peer, err := pool.Get(ctx)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if _, err := peer.Command(nsq.Ping()); err == nil {
+		t.Fatal("expected Command to fail when the peer drops the connection")
+	}
+	pool.Put(peer)
+
+	peer2, err := pool.Get(ctx)
+	if err != nil {
+		t.Fatalf("Get after eviction: %v", err)
+	}
+	defer pool.Put(peer2)
+
+	// A dial's TCP handshake completes (unblocking Get) before the fake
+	// server's Accept loop has necessarily run, so force a round trip
+	// before asserting on accepts to make sure the server side has caught
+	// up.
+	peer2.Command(nsq.Ping())
+
+	if got := atomic.LoadInt32(&accepts); got != 2 {
+		t.Fatalf("expected the broken connection to be discarded and a fresh one dialed, got %d accepted connections", got)
+	}
+}
@@ -0,0 +1,76 @@
+package clusterinfo
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/youzan/go-nsq"
+)
+
+// TestDisconnectCategoryBucketsKnownReasons verifies that closeWithReason's
+// free-form reason strings collapse to the small fixed set of categories
+// documented on LookupObserver.OnDisconnect, regardless of the
+// per-connection detail (error text, addresses) embedded in the original
+// reason.
+func TestDisconnectCategoryBucketsKnownReasons(t *testing.T) {
+	tests := []struct {
+		reason string
+		want   string
+	}{
+		{"write failed: write tcp 10.0.0.1:4161: broken pipe", "write_error"},
+		{"read failed: EOF", "read_error"},
+		{"negotiate failed: x509: certificate signed by unknown authority", "negotiate_failed"},
+		{"closed", "closed"},
+		{"something unexpected", "other"},
+	}
+	for _, tt := range tests {
+		if got := disconnectCategory(tt.reason); got != tt.want {
+			t.Errorf("disconnectCategory(%q) = %q, want %q", tt.reason, got, tt.want)
+		}
+	}
+}
+
+// fakeObserver records the arguments passed to OnDisconnect, without caring
+// about OnConnect/OnCommand.
+type fakeObserver struct {
+	disconnectAddr   string
+	disconnectReason string
+}
+
+func (f *fakeObserver) OnConnect(addr string, err error, dur time.Duration) {}
+func (f *fakeObserver) OnCommand(ctx context.Context, addr, cmdName string, respSize int, err error, dur time.Duration) {
+}
+func (f *fakeObserver) OnDisconnect(addr, reason string) {
+	f.disconnectAddr = addr
+	f.disconnectReason = reason
+}
+
+// TestCommandContextReportsBucketedDisconnectReason verifies that a read
+// failure on the synchronous path reaches the observer as a bucketed
+// category rather than the raw, addr-embedding error text, so it's safe to
+// use as a Prometheus label.
+func TestCommandContextReportsBucketedDisconnectReason(t *testing.T) {
+	addr, stop := newFakeLookupd(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		readCommandLine(r)
+		conn.Close()
+	})
+	defer stop()
+
+	obs := &fakeObserver{}
+	lp := NewLookupPeer(addr, 4096, nil, nil, WithObserver(obs))
+	defer lp.Close()
+
+	// The server closes right after reading the command, so the read that
+	// follows the write fails.
+	if _, err := lp.Command(nsq.Ping()); err == nil {
+		t.Fatal("expected Command to fail when the peer drops the connection")
+	}
+
+	if obs.disconnectReason != "read_error" {
+		t.Fatalf("OnDisconnect reason = %q, want the bucketed category %q", obs.disconnectReason, "read_error")
+	}
+}
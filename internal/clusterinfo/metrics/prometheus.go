@@ -0,0 +1,131 @@
+// Package metrics provides clusterinfo.LookupObserver implementations for
+// instrumenting LookupPeer connect/command/disconnect events.
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusObserver is a clusterinfo.LookupObserver backed by Prometheus
+// counters and histograms, labeled by lookupd address and, for commands, by
+// command name (IDENTIFY, REGISTER, UNREGISTER, LOOKUP, PING, etc.).
+//
+// It implements prometheus.Collector, so callers register it directly with
+// prometheus.MustRegister instead of registering individual metrics.
+type PrometheusObserver struct {
+	connects    *prometheus.CounterVec
+	connectDur  *prometheus.HistogramVec
+	commands    *prometheus.CounterVec
+	commandDur  *prometheus.HistogramVec
+	respSize    *prometheus.HistogramVec
+	disconnects *prometheus.CounterVec
+}
+
+// NewPrometheusObserver builds a PrometheusObserver with metric names
+// prefixed by namespace (e.g. "nsqd", "nsqadmin").
+func NewPrometheusObserver(namespace string) *PrometheusObserver {
+	const subsystem = "lookup_peer"
+	return &PrometheusObserver{
+		connects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "connects_total",
+			Help:      "Total number of connect attempts to nsqlookupd, labeled by result.",
+		}, []string{"addr", "result"}),
+		connectDur: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "connect_duration_seconds",
+			Help:      "Connect latency to nsqlookupd.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"addr"}),
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "commands_total",
+			Help:      "Total number of lookupd commands, labeled by command and result.",
+		}, []string{"addr", "command", "result"}),
+		commandDur: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "command_duration_seconds",
+			Help:      "Round-trip latency of lookupd commands.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"addr", "command"}),
+		respSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "response_bytes",
+			Help:      "Response body size of successful lookupd commands.",
+			Buckets:   prometheus.ExponentialBuckets(16, 4, 8),
+		}, []string{"addr", "command"}),
+		disconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "disconnects_total",
+			Help:      "Total number of lookupd disconnects, labeled by reason.",
+		}, []string{"addr", "reason"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (p *PrometheusObserver) Describe(ch chan<- *prometheus.Desc) {
+	p.connects.Describe(ch)
+	p.connectDur.Describe(ch)
+	p.commands.Describe(ch)
+	p.commandDur.Describe(ch)
+	p.respSize.Describe(ch)
+	p.disconnects.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (p *PrometheusObserver) Collect(ch chan<- prometheus.Metric) {
+	p.connects.Collect(ch)
+	p.connectDur.Collect(ch)
+	p.commands.Collect(ch)
+	p.commandDur.Collect(ch)
+	p.respSize.Collect(ch)
+	p.disconnects.Collect(ch)
+}
+
+// OnConnect implements clusterinfo.LookupObserver.
+func (p *PrometheusObserver) OnConnect(addr string, err error, dur time.Duration) {
+	p.connects.WithLabelValues(addr, resultLabel(err)).Inc()
+	p.connectDur.WithLabelValues(addr).Observe(dur.Seconds())
+}
+
+// OnCommand implements clusterinfo.LookupObserver. ctx is unused here since
+// Prometheus metrics carry no trace context, but is part of the interface
+// so tracing implementations can nest spans under the caller.
+func (p *PrometheusObserver) OnCommand(ctx context.Context, addr, cmdName string, respSize int, err error, dur time.Duration) {
+	name := commandName(cmdName)
+	p.commands.WithLabelValues(addr, name, resultLabel(err)).Inc()
+	p.commandDur.WithLabelValues(addr, name).Observe(dur.Seconds())
+	if err == nil {
+		p.respSize.WithLabelValues(addr, name).Observe(float64(respSize))
+	}
+}
+
+// OnDisconnect implements clusterinfo.LookupObserver.
+func (p *PrometheusObserver) OnDisconnect(addr, reason string) {
+	p.disconnects.WithLabelValues(addr, reason).Inc()
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// commandName normalizes an nsq.Command.Name for use as a low-cardinality
+// metric label.
+func commandName(name string) string {
+	if name == "" {
+		return "unknown"
+	}
+	return name
+}
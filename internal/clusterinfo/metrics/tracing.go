@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingObserver is a clusterinfo.LookupObserver that records each
+// connect/command/disconnect event as an OpenTelemetry span.
+//
+// LookupObserver hooks fire after the fact (once duration is already
+// known), so spans are reconstructed with explicit start/end timestamps
+// rather than wrapping the call live. OnCommand receives the caller's own
+// context (threaded through LookupPeer.CommandContext), so its span nests
+// under the caller's trace; OnConnect and OnDisconnect have no such context
+// available (connects and closes aren't tied to a single caller) and so
+// remain new root spans.
+type TracingObserver struct {
+	tracer trace.Tracer
+}
+
+// NewTracingObserver builds a TracingObserver using the named tracer from
+// the global OpenTelemetry TracerProvider.
+func NewTracingObserver(tracerName string) *TracingObserver {
+	return &TracingObserver{tracer: otel.Tracer(tracerName)}
+}
+
+// OnConnect implements clusterinfo.LookupObserver.
+func (t *TracingObserver) OnConnect(addr string, err error, dur time.Duration) {
+	t.span(context.Background(), "lookup_peer.connect", dur, err, attribute.String("addr", addr))
+}
+
+// OnCommand implements clusterinfo.LookupObserver. It starts its span from
+// ctx (the caller's context, as passed to LookupPeer.CommandContext) so the
+// span nests under the caller's trace instead of starting a new root.
+func (t *TracingObserver) OnCommand(ctx context.Context, addr, cmdName string, respSize int, err error, dur time.Duration) {
+	t.span(ctx, "lookup_peer.command", dur, err,
+		attribute.String("addr", addr),
+		attribute.String("command", commandName(cmdName)),
+		attribute.Int("response_bytes", respSize),
+	)
+}
+
+// OnDisconnect implements clusterinfo.LookupObserver.
+func (t *TracingObserver) OnDisconnect(addr, reason string) {
+	_, span := t.tracer.Start(context.Background(), "lookup_peer.disconnect", trace.WithAttributes(
+		attribute.String("addr", addr),
+		attribute.String("reason", reason),
+	))
+	span.End()
+}
+
+func (t *TracingObserver) span(ctx context.Context, name string, dur time.Duration, err error, attrs ...attribute.KeyValue) {
+	end := time.Now()
+	start := end.Add(-dur)
+	_, span := t.tracer.Start(ctx, name, trace.WithTimestamp(start), trace.WithAttributes(attrs...))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(end))
+}